@@ -0,0 +1,64 @@
+package common
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// defaultReconnectMaxDelay Used when ClientConfig.ReconnectMaxDelay is not set
+const defaultReconnectMaxDelay = 30 * time.Second
+
+// newBackoffRand Returns the random source used for the backoff jitter. It
+// is seeded from the client ID so every client spreads its retries
+// differently while a given client stays reproducible
+func newBackoffRand(id string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// backoff Returns the delay before the given retry (starting at 1) using
+// exponential backoff with full jitter: a random duration between 0 and
+// ReconnectBaseDelay * 2^(retry-1), capped at ReconnectMaxDelay
+func (c *Client) backoff(retry int) time.Duration {
+	n := int64(c.backoffCeil(retry))
+	if n < math.MaxInt64 {
+		n++
+	}
+	return time.Duration(c.rand.Int63n(n))
+}
+
+// backoffCeil Returns the upper bound of the delay before the given retry.
+// The doubling is clamped to ReconnectMaxDelay before it is computed, so
+// it cannot overflow time.Duration whatever the base delay and retry are
+func (c *Client) backoffCeil(retry int) time.Duration {
+	base, max := c.config.ReconnectBaseDelay, c.config.ReconnectMaxDelay
+	if base <= 0 {
+		return 0
+	}
+	if base >= max {
+		return max
+	}
+	var shift uint
+	if retry > 1 {
+		shift = uint(retry - 1)
+	}
+	if base > math.MaxInt64>>shift || base<<shift >= max {
+		return max
+	}
+	return base << shift
+}
+
+// sleepContext Waits for d or until ctx is cancelled, in which case
+// ctx.Err() is returned
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
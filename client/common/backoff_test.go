@@ -0,0 +1,79 @@
+package common
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoffStaysWithinJitterBounds(t *testing.T) {
+	config := testConfig(nil)
+	config.ReconnectBaseDelay = 100 * time.Millisecond
+	config.ReconnectMaxDelay = 2 * time.Second
+	client := NewClient(config)
+
+	for retry := 1; retry <= 10; retry++ {
+		ceil := config.ReconnectBaseDelay << uint(retry-1)
+		if ceil > config.ReconnectMaxDelay {
+			ceil = config.ReconnectMaxDelay
+		}
+		for i := 0; i < 100; i++ {
+			if delay := client.backoff(retry); delay < 0 || delay > ceil {
+				t.Fatalf("retry %v: expected a delay between 0 and %v, got %v", retry, ceil, delay)
+			}
+		}
+	}
+}
+
+func TestBackoffCeilDoesNotOverflow(t *testing.T) {
+	tests := []struct {
+		base  time.Duration
+		max   time.Duration
+		retry int
+	}{
+		{base: 10 * time.Second, max: time.Minute, retry: 31},
+		{base: 500 * time.Millisecond, max: time.Minute, retry: 21},
+		{base: time.Second, max: math.MaxInt64, retry: 64},
+		{base: time.Second, max: math.MaxInt64, retry: 1000},
+	}
+	for _, test := range tests {
+		config := testConfig(nil)
+		config.ReconnectBaseDelay = test.base
+		config.ReconnectMaxDelay = test.max
+		client := NewClient(config)
+
+		if ceil := client.backoffCeil(test.retry); ceil != test.max {
+			t.Errorf("base %v, retry %v: expected the delay to be capped at %v, got %v", test.base, test.retry, test.max, ceil)
+		}
+		if delay := client.backoff(test.retry); delay < 0 {
+			t.Errorf("base %v, retry %v: expected a non negative delay, got %v", test.base, test.retry, delay)
+		}
+	}
+}
+
+func TestBackoffIsReproduciblePerClient(t *testing.T) {
+	delays := func(id string) []time.Duration {
+		config := testConfig(nil)
+		config.ID = id
+		config.ReconnectBaseDelay = time.Second
+		client := NewClient(config)
+		var delays []time.Duration
+		for retry := 1; retry <= 5; retry++ {
+			delays = append(delays, client.backoff(retry))
+		}
+		return delays
+	}
+
+	first, again, other := delays("1"), delays("1"), delays("2")
+	same, differs := true, false
+	for i := range first {
+		same = same && first[i] == again[i]
+		differs = differs || first[i] != other[i]
+	}
+	if !same {
+		t.Errorf("expected the same delays for the same ID, got %v and %v", first, again)
+	}
+	if !differs {
+		t.Errorf("expected different delays for different IDs, got %v", first)
+	}
+}
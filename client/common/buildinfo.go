@@ -0,0 +1,36 @@
+package common
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Revision VCS revision the client was built from. It is set at build time
+// by the Makefile and the client Dockerfile through
+// -ldflags "-X github.com/7574-sistemas-distribuidos/docker-compose-init/client/common.Revision=<rev>"
+var Revision = "unknown"
+
+// BuildInformation Identifies the build of the client that is running
+type BuildInformation struct {
+	Path      string
+	Version   string
+	Revision  string
+	GoVersion string
+}
+
+// BuildInfo Returns the module path and version embedded in the binary,
+// the VCS revision set at build time and the Go version used to build it
+func BuildInfo() BuildInformation {
+	info := BuildInformation{
+		Version:   "(devel)",
+		Revision:  Revision,
+		GoVersion: runtime.Version(),
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		info.Path = buildInfo.Main.Path
+		if buildInfo.Main.Version != "" {
+			info.Version = buildInfo.Main.Version
+		}
+	}
+	return info
+}
@@ -0,0 +1,22 @@
+package common
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestBuildInfo(t *testing.T) {
+	defer func(revision string) { Revision = revision }(Revision)
+	Revision = "abc123"
+
+	info := BuildInfo()
+	if info.Revision != "abc123" {
+		t.Errorf("expected revision %q, got %q", "abc123", info.Revision)
+	}
+	if info.GoVersion != runtime.Version() {
+		t.Errorf("expected go version %q, got %q", runtime.Version(), info.GoVersion)
+	}
+	if info.Version == "" {
+		t.Errorf("expected a version")
+	}
+}
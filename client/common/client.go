@@ -2,88 +2,790 @@ package common
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/op/go-logging"
+	"github.com/pkg/errors"
 )
 
 var log = logging.MustGetLogger("log")
 
+// defaultConnectTimeout Used when ClientConfig.ConnectTimeout is not set
+const defaultConnectTimeout = 5 * time.Second
+
+// ErrMessageTimeout Returned when the server does not complete a message
+// exchange within ClientConfig.MessageTimeout
+var ErrMessageTimeout = errors.New("message timeout")
+
+// ErrInvalidServerAddress Returned when ClientConfig.ServerAddress is not a
+// valid host:port pair. Dialing is not retried in that case
+var ErrInvalidServerAddress = errors.New("invalid server address")
+
+// ErrInvalidTLSConfig Returned when the CA or the client key pair of the
+// TLS configuration cannot be loaded. Dialing is not retried in that case
+var ErrInvalidTLSConfig = errors.New("invalid TLS config")
+
+// ErrConnectTimeout Returned when the connection to the server cannot be
+// established within ClientConfig.ConnectTimeout
+var ErrConnectTimeout = errors.New("connect timeout")
+
+// ErrConnectionClosed Returned when the server closes the connection before
+// sending any byte of its reply. It wraps io.EOF. A connection closed in
+// the middle of a reply is reported as io.ErrUnexpectedEOF instead
+var ErrConnectionClosed = fmt.Errorf("connection closed by server: %w", io.EOF)
+
+// Dialer Opens the connections to the server. *net.Dialer satisfies it;
+// tests can provide their own to simulate failures without a listener
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
 // ClientConfig Configuration used by the client
 type ClientConfig struct {
 	ID            string
 	ServerAddress string
 	LoopAmount    int
 	LoopPeriod    time.Duration
+	// MessageTimeout bounds the write of a message and the read of its
+	// reply. Zero disables the deadline
+	MessageTimeout time.Duration
+	// MaxConnectRetries is the amount of extra dial attempts made when the
+	// server cannot be reached. Retries wait a random delay of up to
+	// ReconnectBaseDelay, doubling that cap on every retry until it reaches
+	// ReconnectMaxDelay (defaults to defaultReconnectMaxDelay)
+	MaxConnectRetries  int
+	ReconnectBaseDelay time.Duration
+	ReconnectMaxDelay  time.Duration
+	// MessageRetries is the amount of times a message is resent over a
+	// new connection after a transient network error, using the same
+	// backoff as the connection retries
+	MessageRetries int
+	// UseTLS enables TLS on the connection. The server certificate is
+	// verified against CACertPath (or the system pool when empty) unless
+	// InsecureSkipVerify is explicitly set. CertPath and KeyPath are only
+	// needed when the server requires client certificates
+	UseTLS             bool
+	CACertPath         string
+	ServerName         string
+	CertPath           string
+	KeyPath            string
+	InsecureSkipVerify bool
+	// DrainOnShutdown lets the message in flight when the loop is cancelled
+	// finish its exchange before the client stops
+	DrainOnShutdown bool
+	// ShutdownGrace bounds the cleanup once the loop is cancelled: draining
+	// the message in flight and closing the connection share a single
+	// deadline, set when the loop is cancelled. When it expires the client
+	// gives up on them and returns. Zero means no bound
+	ShutdownGrace time.Duration
+	// MaxRunDuration caps the total time StartClientLoop may run. When it
+	// expires the loop stops as if a shutdown was requested. Zero means
+	// no limit
+	MaxRunDuration time.Duration
+	// Dialer used to connect to the server. Defaults to a net.Dialer
+	// configured with KeepAlivePeriod
+	Dialer Dialer
+	// ConnectTimeout bounds every connection attempt, including the TLS
+	// handshake. Defaults to defaultConnectTimeout
+	ConnectTimeout time.Duration
+	// DisableNoDelay enables Nagle's algorithm, which Go disables on every
+	// TCP connection. KeepAlivePeriod sets the period of the TCP keep-alive
+	// probes. The zero values keep the Go defaults: no Nagle and 15s
+	// keep-alive probes. Both only apply to TCP connections
+	DisableNoDelay  bool
+	KeepAlivePeriod time.Duration
+	// Logger used by the client. Defaults to the package logger. Every
+	// line already carries the client_id, so clients running in the same
+	// process can share a backend and still be told apart
+	Logger *logging.Logger
+}
+
+// Validate Checks the configuration and returns an error listing every
+// invalid field, or nil if the configuration can be used
+func (config ClientConfig) Validate() error {
+	var problems []string
+	if config.ID == "" {
+		problems = append(problems, "id must not be empty")
+	}
+	if err := validateServerAddress(config.ServerAddress); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if config.UseTLS {
+		if _, err := newTLSConfig(config); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if config.LoopAmount <= 0 {
+		problems = append(problems, fmt.Sprintf("loop amount must be positive, got %v", config.LoopAmount))
+	}
+	if config.MaxConnectRetries < 0 {
+		problems = append(problems, fmt.Sprintf("max connect retries must not be negative, got %v", config.MaxConnectRetries))
+	}
+	if config.MessageRetries < 0 {
+		problems = append(problems, fmt.Sprintf("message retries must not be negative, got %v", config.MessageRetries))
+	}
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"loop period", config.LoopPeriod},
+		{"message timeout", config.MessageTimeout},
+		{"reconnect base delay", config.ReconnectBaseDelay},
+		{"reconnect max delay", config.ReconnectMaxDelay},
+		{"connect timeout", config.ConnectTimeout},
+		{"keep alive period", config.KeepAlivePeriod},
+		{"max run duration", config.MaxRunDuration},
+		{"shutdown grace", config.ShutdownGrace},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			problems = append(problems, fmt.Sprintf("%v must not be negative, got %v", d.name, d.value))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid client config: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// loopSettings Settings of ClientConfig that can change through Reload
+type loopSettings struct {
+	LoopAmount     int
+	LoopPeriod     time.Duration
+	MessageTimeout time.Duration
 }
 
 // Client Entity that encapsulates how
 type Client struct {
-	config ClientConfig
-	conn   net.Conn
+	// config is not modified after NewClient. The settings that can change
+	// through Reload are kept apart in settings, guarded by configMu
+	config   ClientConfig
+	configMu sync.Mutex
+	settings loopSettings
+	connMu   sync.Mutex
+	conn     net.Conn
+	// rawConn is the connection conn runs on (the TCP connection below
+	// TLS), kept so a stuck close can be forced
+	rawConn net.Conn
+	// tlsConfig is built once from the configuration when UseTLS is set.
+	// tlsErr keeps the error if it could not be built
+	tlsConfig *tls.Config
+	tlsErr    error
+	metrics   clientMetrics
+	rand      *rand.Rand
+	log       *logging.Logger
+
+	// OnMessageSent is called after the server replies to a message and
+	// OnMessageError when a message could not be delivered. Both are
+	// optional and run synchronously in the client loop
+	OnMessageSent  func(msgID int, reply string)
+	OnMessageError func(msgID int, err error)
+	// OnProgress is called after every delivered message with the
+	// percentage of LoopAmount completed so far. Optional
+	OnProgress func(pct float64, msgID int)
+	// OnReconnect is called every time the client is about to reconnect,
+	// before the backoff sleep, with the retry number and the error that
+	// caused it. Optional
+	OnReconnect func(attempt int, err error)
 }
 
 // NewClient Initializes a new client receiving the configuration
 // as a parameter
 func NewClient(config ClientConfig) *Client {
+	if config.Dialer == nil {
+		config.Dialer = &net.Dialer{KeepAlive: config.KeepAlivePeriod}
+	}
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = defaultConnectTimeout
+	}
+	if config.ReconnectMaxDelay <= 0 {
+		config.ReconnectMaxDelay = defaultReconnectMaxDelay
+	}
+	if config.Logger == nil {
+		config.Logger = log
+	}
 	client := &Client{
 		config: config,
+		settings: loopSettings{
+			LoopAmount:     config.LoopAmount,
+			LoopPeriod:     config.LoopPeriod,
+			MessageTimeout: config.MessageTimeout,
+		},
+		rand: newBackoffRand(config.ID),
+		log:  config.Logger,
+	}
+	if config.UseTLS {
+		client.tlsConfig, client.tlsErr = newTLSConfig(config)
 	}
 	return client
 }
 
 // CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
-func (c *Client) createClientSocket() error {
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+// failure, the dial error is returned, wrapping ErrConnectTimeout if
+// ConnectTimeout expired. Cancelling ctx aborts an in-progress dial or
+// TLS handshake
+func (c *Client) createClientSocket(ctx context.Context) error {
+	if err := validateServerAddress(c.config.ServerAddress); err != nil {
+		return err
+	}
+	if c.tlsErr != nil {
+		return c.tlsErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.config.ConnectTimeout)
+	defer cancel()
+	conn, err := c.config.Dialer.DialContext(ctx, "tcp", c.config.ServerAddress)
 	if err != nil {
-		log.Criticalf(
-			"action: connect | result: fail | client_id: %v | error: %v",
-			c.config.ID,
-			err,
-		)
+		return wrapConnectTimeout(ctx, err)
 	}
+	if err := c.configureTCP(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	rawConn := conn
+	if c.config.UseTLS {
+		tlsConn := tls.Client(conn, c.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return wrapConnectTimeout(ctx, err)
+		}
+		conn = tlsConn
+	}
+
+	c.connMu.Lock()
 	c.conn = conn
+	c.rawConn = rawConn
+	c.connMu.Unlock()
 	return nil
 }
 
-// StartClientLoop Send messages to the client until some time threshold is met
-func (c *Client) StartClientLoop() {
-	// There is an autoincremental msgID to identify every message sent
-	// Messages if the message amount threshold has not been surpassed
-	for msgID := 1; msgID <= c.config.LoopAmount; msgID++ {
-		// Create the connection the server in every loop iteration. Send an
-		c.createClientSocket()
-
-		// TODO: Modify the send to avoid short-write
-		fmt.Fprintf(
-			c.conn,
-			"[CLIENT %v] Message N°%v\n",
+// Close Closes the current connection to the server, if any. It is safe
+// to call it more than once and from another goroutine; the client can be
+// used for a new StartClientLoop run afterwards
+func (c *Client) Close() error {
+	conn, _ := c.takeConn()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// takeConn Detaches the current connection from the client and returns it
+// together with its underlying connection. The lock is not held while the
+// connection is closed, so a close that blocks cannot block the client
+func (c *Client) takeConn() (net.Conn, net.Conn) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	conn, rawConn := c.conn, c.rawConn
+	c.conn, c.rawConn = nil, nil
+	return conn, rawConn
+}
+
+// Reload Applies the LoopAmount, LoopPeriod and MessageTimeout of config
+// to a running client. The rest of config is ignored. Changes take effect
+// at the next message boundary, so the message in flight is not affected.
+// If the resulting configuration is not valid, an error is returned and
+// the client keeps its current settings
+func (c *Client) Reload(config ClientConfig) error {
+	updated := c.config
+	updated.LoopAmount = config.LoopAmount
+	updated.LoopPeriod = config.LoopPeriod
+	updated.MessageTimeout = config.MessageTimeout
+	if err := updated.Validate(); err != nil {
+		return err
+	}
+
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+	c.settings = loopSettings{
+		LoopAmount:     updated.LoopAmount,
+		LoopPeriod:     updated.LoopPeriod,
+		MessageTimeout: updated.MessageTimeout,
+	}
+	return nil
+}
+
+// reloadableConfig Returns the current settings that can change through
+// Reload. It is safe to call while Reload may be called concurrently
+func (c *Client) reloadableConfig() loopSettings {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+	return c.settings
+}
+
+// currentConn Returns the current connection, or nil if it was closed
+func (c *Client) currentConn() net.Conn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn
+}
+
+// wrapConnectTimeout Replaces err with ErrConnectTimeout if it was caused
+// by the connect deadline in ctx expiring
+func wrapConnectTimeout(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.Wrap(ErrConnectTimeout, err.Error())
+	}
+	return err
+}
+
+// validateServerAddress Checks that address is a host:port pair with a
+// non empty port. IPv6 hosts must be enclosed in brackets, e.g. [::1]:12345
+func validateServerAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return errors.Wrapf(ErrInvalidServerAddress, "%q: IPv6 addresses must be written as [host]:port", address)
+		}
+		return errors.Wrapf(ErrInvalidServerAddress, "%q: expected host:port", address)
+	}
+	if host == "" {
+		return errors.Wrapf(ErrInvalidServerAddress, "%q: missing host", address)
+	}
+	if port == "" {
+		return errors.Wrapf(ErrInvalidServerAddress, "%q: missing port", address)
+	}
+	return nil
+}
+
+// tcpOptions TCP settings of a connection. *net.TCPConn satisfies it
+type tcpOptions interface {
+	SetNoDelay(noDelay bool) error
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// configureTCP Applies the TCP options of the configuration to conn. Other
+// connection types (e.g. provided by a test Dialer) are left as they are
+func (c *Client) configureTCP(conn net.Conn) error {
+	tcpConn, ok := conn.(tcpOptions)
+	if !ok {
+		return nil
+	}
+	if c.config.DisableNoDelay {
+		if err := tcpConn.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if c.config.KeepAlivePeriod > 0 {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcpConn.SetKeepAlivePeriod(c.config.KeepAlivePeriod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTLSConfig Builds the tls.Config used to dial the server from the
+// TLS fields of config. An error wrapping ErrInvalidTLSConfig is returned
+// if the CA or the client key pair cannot be loaded
+func newTLSConfig(config ClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	// Verify the certificate against the dialed host unless told otherwise
+	if tlsConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(config.ServerAddress); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	if config.CACertPath != "" {
+		caCert, err := ioutil.ReadFile(config.CACertPath)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidTLSConfig, "could not read CA certificate %v: %v", config.CACertPath, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.Wrapf(ErrInvalidTLSConfig, "no valid certificates found in %v", config.CACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertPath != "" || config.KeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertPath, config.KeyPath)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidTLSConfig, "could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// connectWithRetry Creates the client socket retrying with jittered
+// exponential backoff when the server is not reachable yet (e.g. while
+// docker compose is still starting it). Gives up after MaxConnectRetries retries and
+// returns the last dial error, which is printed in stdout/stderr. If ctx
+// is cancelled while waiting between attempts, ctx.Err() is returned
+func (c *Client) connectWithRetry(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		err := c.createClientSocket(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt > c.config.MaxConnectRetries || !isRetryableConnectError(err) {
+			c.log.Criticalf(
+				"action: connect | result: fail | client_id: %v | error: %v",
+				c.config.ID,
+				err,
+			)
+			return err
+		}
+
+		delay := c.backoff(attempt)
+		c.log.Infof("action: reconnect | result: in_progress | client_id: %v | attempt: %v | delay: %v | error: %v",
 			c.config.ID,
-			msgID,
+			attempt,
+			delay,
+			err,
 		)
-		msg, err := bufio.NewReader(c.conn).ReadString('\n')
-		c.conn.Close()
+		c.reconnected(attempt, err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// isRetryableConnectError Checks whether a failed connection attempt may
+// succeed if retried. Configuration errors will fail the same way again
+func isRetryableConnectError(err error) bool {
+	return !errors.Is(err, ErrInvalidServerAddress) && !errors.Is(err, ErrInvalidTLSConfig)
+}
+
+// reconnected Accounts a reconnection and notifies OnReconnect
+func (c *Client) reconnected(attempt int, err error) {
+	atomic.AddInt64(&c.metrics.reconnects, 1)
+	if c.OnReconnect != nil {
+		c.OnReconnect(attempt, err)
+	}
+}
+
+// StartClientLoop Send messages to the client until some time threshold is met.
+// Cancelling ctx (e.g. on SIGTERM) stops the loop promptly, aborting any
+// in-flight dial, write, read or wait and closing the connection. With
+// DrainOnShutdown the in-flight exchange is completed before stopping.
+// If MaxRunDuration is set, the loop is stopped the same way once it expires.
+// A summary of the run is returned together with the error that stopped it,
+// if any (ctx.Err() when it was cancelled, context.DeadlineExceeded when
+// MaxRunDuration expired)
+func (c *Client) StartClientLoop(ctx context.Context) (RunStats, error) {
+	buildInfo := BuildInfo()
+	c.log.Infof("action: build_info | result: success | client_id: %v | version: %v | revision: %v | go_version: %v",
+		c.config.ID,
+		buildInfo.Version,
+		buildInfo.Revision,
+		buildInfo.GoVersion,
+	)
+
+	start := time.Now()
+	before := c.Metrics()
+
+	err := c.runLoop(ctx)
+
+	after := c.Metrics()
+	stats := RunStats{
+		MessagesSent: int(after.MessagesSent - before.MessagesSent),
+		Reconnects:   int(after.Reconnects - before.Reconnects),
+		Duration:     time.Since(start),
+		SendTime:     after.WriteTime + after.WaitTime - before.WriteTime - before.WaitTime,
+	}
+	if exchanges := after.Exchanges - before.Exchanges; exchanges > 0 {
+		stats.AvgLatency = stats.SendTime / time.Duration(exchanges)
+	}
+	return stats, err
+}
+
+// runLoop Sends the messages of a StartClientLoop run
+func (c *Client) runLoop(ctx context.Context) error {
+	if c.config.MaxRunDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.MaxRunDuration)
+		defer cancel()
+	}
 
+	// There is an autoincremental msgID to identify every message sent
+	// Messages if the message amount threshold has not been surpassed
+	for msgID := 1; msgID <= c.reloadableConfig().LoopAmount; msgID++ {
+		atomic.StoreInt64(&c.metrics.currentMessage, int64(msgID))
+		data := fmt.Sprintf("[CLIENT %v] Message N°%v", c.config.ID, msgID)
+		msg, err := c.sendMessage(ctx, data)
+		if err != nil && ctx.Err() != nil {
+			c.logStop(ctx, msgID-1)
+			return ctx.Err()
+		}
 		if err != nil {
-			log.Errorf("action: receive_message | result: fail | client_id: %v | error: %v",
+			atomic.AddInt64(&c.metrics.sendFailures, 1)
+			c.log.Errorf("action: receive_message | result: fail | client_id: %v | error: %v",
 				c.config.ID,
 				err,
 			)
-			return
+			if c.OnMessageError != nil {
+				c.OnMessageError(msgID, err)
+			}
+			return err
 		}
 
-		log.Infof("action: receive_message | result: success | client_id: %v | msg: %v",
+		atomic.AddInt64(&c.metrics.messagesSent, 1)
+		c.log.Infof("action: receive_message | result: success | client_id: %v | msg: %v",
 			c.config.ID,
 			msg,
 		)
+		if c.OnMessageSent != nil {
+			c.OnMessageSent(msgID, msg)
+		}
+		if c.OnProgress != nil {
+			c.OnProgress(100*float64(msgID)/float64(c.reloadableConfig().LoopAmount), msgID)
+		}
 
 		// Wait a time between sending one message and the next one
-		time.Sleep(c.config.LoopPeriod)
+		select {
+		case <-ctx.Done():
+			c.logStop(ctx, msgID)
+			return ctx.Err()
+		case <-time.After(c.reloadableConfig().LoopPeriod):
+		}
+	}
+	c.log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	return nil
+}
+
+// logStop Logs why the loop was stopped before sending every message:
+// either MaxRunDuration expired or a shutdown was requested
+func (c *Client) logStop(ctx context.Context, messagesSent int) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		c.log.Infof("action: max_run_duration | result: success | client_id: %v | messages_sent: %v | max_run_duration: %v",
+			c.config.ID,
+			messagesSent,
+			c.config.MaxRunDuration,
+		)
+		return
+	}
+	c.log.Infof("action: shutdown | result: success | client_id: %v | messages_sent: %v",
+		c.config.ID,
+		messagesSent,
+	)
+}
+
+// SendMessage Sends a single line of text to the server and returns its
+// reply. It goes through the same connection, timeout and retry handling
+// as StartClientLoop, so it can be used to feed the server from sources
+// other than the client loop. It must not be called concurrently with
+// StartClientLoop or another SendMessage on the same client
+func (c *Client) SendMessage(ctx context.Context, text string) (string, error) {
+	if strings.ContainsAny(text, "\r\n") {
+		return "", errors.New("message must be a single line")
+	}
+	return c.sendMessage(ctx, text)
+}
+
+// sendMessage Creates a new connection to the server and exchanges the
+// message through it. Transient network errors are retried up to
+// MessageRetries times, always resending the same message
+func (c *Client) sendMessage(ctx context.Context, text string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		// Create the connection the server in every loop iteration
+		if err := c.connectWithRetry(ctx); err != nil {
+			return "", err
+		}
+
+		// Once the message is on its way, only a non draining shutdown
+		// may interrupt it. Draining and closing share the same grace
+		graceCtx, cancelGrace := c.graceContext(ctx)
+		exchangeCtx := ctx
+		if c.config.DrainOnShutdown {
+			exchangeCtx = graceCtx
+		}
+		msg, err := c.exchangeMessage(exchangeCtx, text)
+		c.closeConn(graceCtx)
+		cancelGrace()
+
+		if err == nil {
+			return msg, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if !isTransient(err) || attempt >= c.config.MessageRetries {
+			return msg, err
+		}
+
+		delay := c.backoff(attempt + 1)
+		c.log.Warningf("action: send_message | result: retry | client_id: %v | msg: %v | attempt: %v | delay: %v | error: %v",
+			c.config.ID,
+			text,
+			attempt+1,
+			delay,
+			err,
+		)
+		c.reconnected(attempt+1, err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return "", err
+		}
+	}
+}
+
+// graceContext Returns the context bounding the cleanup of the message in
+// flight. It is not cancelled by ctx itself, only ShutdownGrace after ctx is
+// done, so the drain and the close that follows it share one deadline
+func (c *Client) graceContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.Background())
+	if c.config.ShutdownGrace <= 0 {
+		return graceCtx, cancel
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-graceCtx.Done():
+			return
+		}
+		select {
+		case <-time.After(c.config.ShutdownGrace):
+			cancel()
+		case <-graceCtx.Done():
+		}
+	}()
+	return graceCtx, cancel
+}
+
+// closeConn Closes the current connection, waiting for it until graceCtx is
+// done (e.g. a TLS close_notify stuck on a dead peer). Then the connection
+// is force-closed: its deadline is expired to unblock any pending I/O and
+// the underlying connection is closed, and the client stops waiting for it
+func (c *Client) closeConn(graceCtx context.Context) {
+	conn, rawConn := c.takeConn()
+	if conn == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-graceCtx.Done():
+		c.log.Warningf("action: close_connection | result: fail | client_id: %v | error: close did not finish within %v, forcing it",
+			c.config.ID,
+			c.config.ShutdownGrace,
+		)
+		conn.SetDeadline(time.Now())
+		if rawConn != conn {
+			rawConn.Close()
+		}
+	}
+}
+
+// isTransient Checks whether err is a network error worth retrying the
+// message for, i.e. a timeout or the server dropping the connection
+func isTransient(err error) bool {
+	return errors.Is(err, ErrMessageTimeout) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// exchangeMessage Sends the message as a single line through the current
+// connection and waits for the server reply. If MessageTimeout is set, the
+// whole exchange must finish before it expires or ErrMessageTimeout is
+// returned. The connection is closed by the caller after every exchange, so
+// a timed out read never leaks into the next message. Cancelling ctx
+// unblocks the exchange by expiring the connection deadline
+func (c *Client) exchangeMessage(ctx context.Context, text string) (string, error) {
+	conn := c.currentConn()
+	if conn == nil {
+		return "", net.ErrClosed
+	}
+
+	if timeout := c.reloadableConfig().MessageTimeout; timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return "", err
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	writeStart := time.Now()
+	if err := writeFull(conn, []byte(text+"\n")); err != nil {
+		return "", wrapTimeout(err)
+	}
+	writeTime := time.Since(writeStart)
+
+	// ReadString keeps reading until the delimiter arrives, so short reads
+	// are already handled by bufio
+	waitStart := time.Now()
+	msg, err := bufio.NewReader(conn).ReadString('\n')
+	waitTime := time.Since(waitStart)
+	if err == io.EOF {
+		if msg == "" {
+			return "", ErrConnectionClosed
+		}
+		return "", errors.Wrapf(io.ErrUnexpectedEOF, "reply truncated after %d bytes without a newline", len(msg))
+	}
+	if err != nil {
+		return "", wrapTimeout(err)
+	}
+
+	c.recordExchange(writeTime, waitTime)
+	c.log.Infof("action: message_timing | result: success | client_id: %v | write_time: %v | wait_time: %v",
+		c.config.ID,
+		writeTime,
+		waitTime,
+	)
+	return msg, nil
+}
+
+// writeFull Writes the whole buffer to w, retrying on short writes. An
+// error is returned if w fails or stops accepting data
+func writeFull(w io.Writer, buf []byte) error {
+	for written := 0; written < len(buf); {
+		n, err := w.Write(buf[written:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		written += n
+	}
+	return nil
+}
 
+// wrapTimeout Replaces network timeouts with ErrMessageTimeout so callers
+// can tell them apart from other connection errors
+func wrapTimeout(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return errors.Wrap(ErrMessageTimeout, err.Error())
 	}
-	log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	return err
 }
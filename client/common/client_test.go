@@ -0,0 +1,1059 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/testutil"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the client logs out of the test output
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+	os.Exit(m.Run())
+}
+
+// dialerFunc Adapts a function to the Dialer interface
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// testConfig Returns a valid configuration that sends a single message
+// through dialer without waiting between messages or retries
+func testConfig(dialer Dialer) ClientConfig {
+	return ClientConfig{
+		ID:                 "1",
+		ServerAddress:      "server:12345",
+		LoopAmount:         1,
+		ReconnectBaseDelay: time.Millisecond,
+		Dialer:             dialer,
+	}
+}
+
+// unusedAddress Returns a local TCP address nothing is listening on
+func unusedAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func TestConnectWithRetryWaitsForLateServer(t *testing.T) {
+	address := unusedAddress(t)
+	server := testutil.NewMockServer()
+	defer server.Close()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := server.Listen(address); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	config := testConfig(nil)
+	config.ServerAddress = address
+	config.MaxConnectRetries = 20
+	config.ReconnectBaseDelay = 10 * time.Millisecond
+	config.ReconnectMaxDelay = 50 * time.Millisecond
+	client := NewClient(config)
+
+	stats, err := client.StartClientLoop(context.Background())
+	if err != nil {
+		t.Fatalf("expected the client to connect once the server started, got %v", err)
+	}
+	if stats.MessagesSent != 1 {
+		t.Errorf("expected 1 message sent, got %v", stats.MessagesSent)
+	}
+	if stats.Reconnects == 0 {
+		t.Errorf("expected the client to retry the connection")
+	}
+}
+
+func TestConnectWithRetryGivesUp(t *testing.T) {
+	dials := 0
+	dialErr := errors.New("connection refused")
+	config := testConfig(dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		return nil, dialErr
+	}))
+	config.MaxConnectRetries = 2
+	client := NewClient(config)
+
+	_, err := client.StartClientLoop(context.Background())
+	if !errors.Is(err, dialErr) {
+		t.Fatalf("expected the dial error, got %v", err)
+	}
+	if dials != 3 {
+		t.Errorf("expected 3 dial attempts, got %v", dials)
+	}
+}
+
+func TestSendMessageResendsAfterTransientError(t *testing.T) {
+	server := testutil.NewMockServer(testutil.CloseEarly)
+	defer server.Close()
+	config := testConfig(server)
+	config.MessageRetries = 1
+	client := NewClient(config)
+
+	reply, err := client.SendMessage(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("expected the message to be delivered on retry, got %v", err)
+	}
+	if reply != "hello\n" {
+		t.Errorf("expected reply %q, got %q", "hello\n", reply)
+	}
+	received := server.Received()
+	if len(received) != 2 || received[0] != "hello" || received[1] != "hello" {
+		t.Errorf("expected the same message to be sent twice, got %q", received)
+	}
+}
+
+func TestSendMessageGivesUpAfterRetries(t *testing.T) {
+	server := testutil.NewMockServer(testutil.CloseEarly, testutil.CloseEarly, testutil.CloseEarly)
+	defer server.Close()
+	config := testConfig(server)
+	config.MessageRetries = 2
+	client := NewClient(config)
+
+	_, err := client.SendMessage(context.Background(), "hello")
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+	if server.Connections() != 3 {
+		t.Errorf("expected 3 attempts, got %v", server.Connections())
+	}
+}
+
+func TestStartClientLoopStopsOnCancelDuringSend(t *testing.T) {
+	server := testutil.NewMockServer(testutil.Hang)
+	defer server.Close()
+	client := NewClient(testConfig(server))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	stats, err := client.StartClientLoop(ctx)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the loop to stop promptly, took %v", elapsed)
+	}
+	if stats.MessagesSent != 0 {
+		t.Errorf("expected no message sent, got %v", stats.MessagesSent)
+	}
+}
+
+// newTestCertificate Returns a self-signed certificate for localhost and
+// the path of a PEM file holding it, to be used as the CA
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(caPath, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caPath
+}
+
+// tlsEchoDialer Returns a Dialer whose connections lead to an in-memory
+// TLS server that echoes a single line back with the given certificate
+func tlsEchoDialer(cert tls.Certificate) Dialer {
+	return dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			// Close the pipe itself: net.Pipe is unbuffered, so a close_notify
+			// sent by both ends at once would block until the TLS timeout
+			defer server.Close()
+			conn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+			msg, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, msg)
+		}()
+		return client, nil
+	})
+}
+
+func TestTLSVerifiesServerAgainstCA(t *testing.T) {
+	cert, caPath := newTestCertificate(t)
+	config := testConfig(tlsEchoDialer(cert))
+	config.ServerAddress = "localhost:12345"
+	config.UseTLS = true
+	config.CACertPath = caPath
+	client := NewClient(config)
+
+	reply, err := client.SendMessage(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("expected the TLS exchange to succeed, got %v", err)
+	}
+	if reply != "hello\n" {
+		t.Errorf("expected reply %q, got %q", "hello\n", reply)
+	}
+}
+
+func TestTLSRejectsUnknownAuthority(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	config := testConfig(tlsEchoDialer(cert))
+	config.ServerAddress = "localhost:12345"
+	config.UseTLS = true
+	client := NewClient(config)
+
+	_, err := client.SendMessage(context.Background(), "hello")
+	var unknownAuthority x509.UnknownAuthorityError
+	if !errors.As(err, &unknownAuthority) {
+		t.Fatalf("expected the server certificate to be rejected, got %v", err)
+	}
+}
+
+func TestTLSInsecureSkipVerify(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	config := testConfig(tlsEchoDialer(cert))
+	config.ServerAddress = "localhost:12345"
+	config.UseTLS = true
+	config.InsecureSkipVerify = true
+	client := NewClient(config)
+
+	if _, err := client.SendMessage(context.Background(), "hello"); err != nil {
+		t.Fatalf("expected verification to be skipped, got %v", err)
+	}
+}
+
+func TestTLSInvalidCAFailsFast(t *testing.T) {
+	dials := 0
+	config := testConfig(dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		return nil, errors.New("unexpected dial")
+	}))
+	config.UseTLS = true
+	config.CACertPath = filepath.Join(t.TempDir(), "missing.pem")
+	config.MaxConnectRetries = 3
+
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected Validate to reject the missing CA")
+	}
+	client := NewClient(config)
+	_, err := client.SendMessage(context.Background(), "hello")
+	if !errors.Is(err, ErrInvalidTLSConfig) {
+		t.Fatalf("expected ErrInvalidTLSConfig, got %v", err)
+	}
+	if dials != 0 {
+		t.Errorf("expected no dial attempt, got %v", dials)
+	}
+}
+
+func TestDrainOnShutdownCompletesMessageInFlight(t *testing.T) {
+	for _, drain := range []bool{false, true} {
+		server := testutil.NewMockServer()
+		server.ReplyDelay = 200 * time.Millisecond
+		config := testConfig(server)
+		config.LoopAmount = 5
+		config.DrainOnShutdown = drain
+		client := NewClient(config)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		stats, err := client.StartClientLoop(ctx)
+		server.Close()
+
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("drain %v: expected context.Canceled, got %v", drain, err)
+		}
+		expected := 0
+		if drain {
+			expected = 1
+		}
+		if stats.MessagesSent != expected {
+			t.Errorf("drain %v: expected %v messages sent, got %v", drain, expected, stats.MessagesSent)
+		}
+	}
+}
+
+func TestMaxRunDurationStopsLoopEarly(t *testing.T) {
+	server := testutil.NewMockServer()
+	defer server.Close()
+	config := testConfig(server)
+	config.LoopAmount = 100
+	config.LoopPeriod = 20 * time.Millisecond
+	config.MaxRunDuration = 100 * time.Millisecond
+	client := NewClient(config)
+
+	stats, err := client.StartClientLoop(context.Background())
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if stats.Duration > time.Second {
+		t.Errorf("expected the loop to stop near MaxRunDuration, took %v", stats.Duration)
+	}
+	if stats.MessagesSent == 0 || stats.MessagesSent >= config.LoopAmount {
+		t.Errorf("expected some but not all messages sent, got %v", stats.MessagesSent)
+	}
+}
+
+// tcpOptionsConn Connection recording the TCP options set on it
+type tcpOptionsConn struct {
+	net.Conn
+	noDelay         bool
+	keepAlive       bool
+	keepAlivePeriod time.Duration
+}
+
+func (c *tcpOptionsConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = noDelay
+	return nil
+}
+
+func (c *tcpOptionsConn) SetKeepAlive(keepAlive bool) error {
+	c.keepAlive = keepAlive
+	return nil
+}
+
+func (c *tcpOptionsConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlivePeriod = d
+	return nil
+}
+
+func TestTCPOptionsAreApplied(t *testing.T) {
+	tests := []struct {
+		name            string
+		disableNoDelay  bool
+		keepAlivePeriod time.Duration
+		noDelay         bool
+		expectedPeriod  time.Duration
+	}{
+		{name: "zero values keep the Go defaults", noDelay: true, expectedPeriod: 15 * time.Second},
+		{name: "options set", disableNoDelay: true, keepAlivePeriod: 30 * time.Second, noDelay: false, expectedPeriod: 30 * time.Second},
+	}
+	for _, test := range tests {
+		server := testutil.NewMockServer()
+		var conn *tcpOptionsConn
+		config := testConfig(dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			pipe, err := server.DialContext(ctx, network, address)
+			// Start from the options Go sets on a new TCP connection
+			conn = &tcpOptionsConn{Conn: pipe, noDelay: true, keepAlive: true, keepAlivePeriod: 15 * time.Second}
+			return conn, err
+		}))
+		config.DisableNoDelay = test.disableNoDelay
+		config.KeepAlivePeriod = test.keepAlivePeriod
+		client := NewClient(config)
+
+		_, err := client.SendMessage(context.Background(), "hello")
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.noDelay != test.noDelay {
+			t.Errorf("%v: expected no delay %v, got %v", test.name, test.noDelay, conn.noDelay)
+		}
+		if !conn.keepAlive {
+			t.Errorf("%v: expected keep alive to stay enabled", test.name)
+		}
+		if conn.keepAlivePeriod != test.expectedPeriod {
+			t.Errorf("%v: expected keep alive period %v, got %v", test.name, test.expectedPeriod, conn.keepAlivePeriod)
+		}
+	}
+}
+
+func TestDefaultDialerKeepAlive(t *testing.T) {
+	// Zero leaves the Go default keep-alive of the net.Dialer
+	for _, period := range []time.Duration{0, 30 * time.Second} {
+		config := testConfig(nil)
+		config.KeepAlivePeriod = period
+		client := NewClient(config)
+
+		dialer, ok := client.config.Dialer.(*net.Dialer)
+		if !ok {
+			t.Fatalf("expected a *net.Dialer, got %T", client.config.Dialer)
+		}
+		if dialer.KeepAlive != period {
+			t.Errorf("expected dialer keep alive %v, got %v", period, dialer.KeepAlive)
+		}
+	}
+}
+
+func TestOnMessageSentHook(t *testing.T) {
+	server := testutil.NewMockServer()
+	defer server.Close()
+	config := testConfig(server)
+	config.LoopAmount = 3
+	client := NewClient(config)
+	var sent []int
+	client.OnMessageSent = func(msgID int, reply string) {
+		expected := fmt.Sprintf("[CLIENT 1] Message N°%v\n", msgID)
+		if reply != expected {
+			t.Errorf("message %v: expected reply %q, got %q", msgID, expected, reply)
+		}
+		sent = append(sent, msgID)
+	}
+	client.OnMessageError = func(msgID int, err error) {
+		t.Errorf("unexpected error for message %v: %v", msgID, err)
+	}
+
+	if _, err := client.StartClientLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sent) != "[1 2 3]" {
+		t.Errorf("expected the hook to be called for messages [1 2 3], got %v", sent)
+	}
+}
+
+func TestOnMessageErrorHook(t *testing.T) {
+	server := testutil.NewMockServer(testutil.Echo, testutil.CloseEarly)
+	defer server.Close()
+	config := testConfig(server)
+	config.LoopAmount = 3
+	client := NewClient(config)
+	failedID := 0
+	var failedErr error
+	client.OnMessageError = func(msgID int, err error) {
+		failedID, failedErr = msgID, err
+	}
+
+	_, err := client.StartClientLoop(context.Background())
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+	if failedID != 2 || failedErr != err {
+		t.Errorf("expected the hook to be called for message 2 with %v, got message %v with %v", err, failedID, failedErr)
+	}
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	server := testutil.NewMockServer()
+	defer server.Close()
+	client := NewClient(testConfig(server))
+	if err := client.createClientSocket(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Errorf("expected the first Close to succeed, got %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("expected the second Close to be a no-op, got %v", err)
+	}
+	if client.currentConn() != nil {
+		t.Errorf("expected no connection after Close")
+	}
+}
+
+func TestClientIsReusableAfterRun(t *testing.T) {
+	server := testutil.NewMockServer()
+	defer server.Close()
+	config := testConfig(server)
+	config.LoopAmount = 2
+	client := NewClient(config)
+
+	for run := 1; run <= 2; run++ {
+		stats, err := client.StartClientLoop(context.Background())
+		if err != nil {
+			t.Fatalf("run %v: %v", run, err)
+		}
+		if stats.MessagesSent != 2 {
+			t.Errorf("run %v: expected 2 messages sent, got %v", run, stats.MessagesSent)
+		}
+		client.Close()
+	}
+	if len(server.Received()) != 4 {
+		t.Errorf("expected 4 messages received, got %v", len(server.Received()))
+	}
+}
+
+func TestConnectionClosedBeforeReply(t *testing.T) {
+	server := testutil.NewMockServer(testutil.CloseEarly)
+	defer server.Close()
+	client := NewClient(testConfig(server))
+
+	_, err := client.SendMessage(context.Background(), "hello")
+	if !errors.Is(err, ErrConnectionClosed) || !errors.Is(err, io.EOF) {
+		t.Errorf("expected ErrConnectionClosed wrapping io.EOF, got %v", err)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("did not expect io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestConnectionClosedMidReply(t *testing.T) {
+	server := testutil.NewMockServer(testutil.Truncate)
+	defer server.Close()
+	client := NewClient(testConfig(server))
+
+	_, err := client.SendMessage(context.Background(), "hello")
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("did not expect ErrConnectionClosed, got %v", err)
+	}
+}
+
+func TestReloadAppliesAtNextMessage(t *testing.T) {
+	server := testutil.NewMockServer()
+	defer server.Close()
+	config := testConfig(server)
+	config.LoopAmount = 2
+	client := NewClient(config)
+	client.OnMessageSent = func(msgID int, reply string) {
+		if msgID == 1 {
+			reloaded := config
+			reloaded.LoopAmount = 4
+			if err := client.Reload(reloaded); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	stats, err := client.StartClientLoop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MessagesSent != 4 {
+		t.Errorf("expected the reloaded loop amount to send 4 messages, got %v", stats.MessagesSent)
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	config := testConfig(nil)
+	config.LoopPeriod = time.Second
+	client := NewClient(config)
+
+	reloaded := config
+	reloaded.LoopAmount = 10
+	reloaded.LoopPeriod = -time.Second
+	if err := client.Reload(reloaded); err == nil {
+		t.Fatalf("expected a negative loop period to be rejected")
+	}
+	current := client.reloadableConfig()
+	if current.LoopAmount != 1 || current.LoopPeriod != time.Second {
+		t.Errorf("expected the settings to be kept, got loop amount %v and period %v", current.LoopAmount, current.LoopPeriod)
+	}
+}
+
+func TestSendMessageFromExternalSource(t *testing.T) {
+	server := testutil.NewMockServer()
+	defer server.Close()
+	client := NewClient(testConfig(server))
+
+	messages := []string{"bet 1", "bet 2", "bet 3"}
+	for _, msg := range messages {
+		reply, err := client.SendMessage(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != msg+"\n" {
+			t.Errorf("expected reply %q, got %q", msg+"\n", reply)
+		}
+	}
+	if fmt.Sprint(server.Received()) != fmt.Sprint(messages) {
+		t.Errorf("expected the server to receive %q, got %q", messages, server.Received())
+	}
+}
+
+func TestSendMessageRejectsMultipleLines(t *testing.T) {
+	server := testutil.NewMockServer()
+	defer server.Close()
+	client := NewClient(testConfig(server))
+
+	if _, err := client.SendMessage(context.Background(), "bet 1\nbet 2"); err == nil {
+		t.Errorf("expected a multi-line message to be rejected")
+	}
+	if server.Connections() != 0 {
+		t.Errorf("expected no connection to be opened, got %v", server.Connections())
+	}
+}
+
+func TestTimingIsRecorded(t *testing.T) {
+	server := testutil.NewMockServer()
+	server.ReplyDelay = 20 * time.Millisecond
+	defer server.Close()
+	config := testConfig(server)
+	config.LoopAmount = 2
+	client := NewClient(config)
+
+	stats, err := client.StartClientLoop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := client.Metrics()
+	if metrics.Exchanges != 2 {
+		t.Errorf("expected 2 exchanges, got %v", metrics.Exchanges)
+	}
+	if metrics.WriteTime < 0 {
+		t.Errorf("expected a non negative write time, got %v", metrics.WriteTime)
+	}
+	if metrics.WaitTime < 2*server.ReplyDelay {
+		t.Errorf("expected the wait time to include the reply delays, got %v", metrics.WaitTime)
+	}
+	if stats.SendTime != metrics.WriteTime+metrics.WaitTime {
+		t.Errorf("expected send time %v, got %v", metrics.WriteTime+metrics.WaitTime, stats.SendTime)
+	}
+	if stats.AvgLatency != stats.SendTime/2 {
+		t.Errorf("expected average latency %v, got %v", stats.SendTime/2, stats.AvgLatency)
+	}
+}
+
+func TestValidateServerAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		valid   bool
+	}{
+		{"127.0.0.1:12345", true},
+		{"[::1]:12345", true},
+		{"server:12345", true},
+		{"server", false},
+		{"server:", false},
+		{":12345", false},
+		{"::1:12345", false},
+	}
+	for _, test := range tests {
+		err := validateServerAddress(test.address)
+		if test.valid && err != nil {
+			t.Errorf("%q: expected a valid address, got %v", test.address, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidServerAddress) {
+			t.Errorf("%q: expected ErrInvalidServerAddress, got %v", test.address, err)
+		}
+	}
+}
+
+func TestInvalidServerAddressIsNotDialed(t *testing.T) {
+	dials := 0
+	config := testConfig(dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		return nil, errors.New("unexpected dial")
+	}))
+	config.ServerAddress = "server"
+	config.MaxConnectRetries = 3
+	client := NewClient(config)
+
+	_, err := client.SendMessage(context.Background(), "hello")
+	if !errors.Is(err, ErrInvalidServerAddress) {
+		t.Fatalf("expected ErrInvalidServerAddress, got %v", err)
+	}
+	if dials != 0 {
+		t.Errorf("expected no dial attempt, got %v", dials)
+	}
+}
+
+// hangingDialer Dialer that never connects, like an unroutable host. The
+// dial only returns once ctx is done
+var hangingDialer = dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+})
+
+func TestConnectTimeout(t *testing.T) {
+	config := testConfig(hangingDialer)
+	config.ConnectTimeout = 50 * time.Millisecond
+	client := NewClient(config)
+
+	start := time.Now()
+	_, err := client.SendMessage(context.Background(), "hello")
+	if !errors.Is(err, ErrConnectTimeout) {
+		t.Fatalf("expected ErrConnectTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the dial to time out after ConnectTimeout, took %v", elapsed)
+	}
+}
+
+func TestValidateAcceptsValidConfig(t *testing.T) {
+	if err := testConfig(nil).Validate(); err != nil {
+		t.Errorf("expected a valid config, got %v", err)
+	}
+}
+
+func TestValidateListsEveryProblem(t *testing.T) {
+	config := ClientConfig{
+		ServerAddress:  "server",
+		LoopPeriod:     -time.Second,
+		MessageRetries: -1,
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("expected an invalid config")
+	}
+	for _, problem := range []string{"id", "server", "loop amount", "loop period", "message retries"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected the error to mention %q, got %v", problem, err)
+		}
+	}
+}
+
+func TestTruncatedReplyReportsBytesReceived(t *testing.T) {
+	server := testutil.NewMockServer(testutil.Truncate)
+	defer server.Close()
+	client := NewClient(testConfig(server))
+
+	_, err := client.SendMessage(context.Background(), "hello world")
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "after 5 bytes") {
+		t.Errorf("expected the error to report the 5 bytes received, got %v", err)
+	}
+}
+
+func TestOnProgressReportsIncreasingPercentages(t *testing.T) {
+	server := testutil.NewMockServer()
+	defer server.Close()
+	config := testConfig(server)
+	config.LoopAmount = 4
+	client := NewClient(config)
+	var progress []float64
+	client.OnProgress = func(pct float64, msgID int) {
+		progress = append(progress, pct)
+	}
+
+	if _, err := client.StartClientLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(progress) != "[25 50 75 100]" {
+		t.Errorf("expected progress [25 50 75 100], got %v", progress)
+	}
+}
+
+// blockingCloseConn Connection whose Close blocks until release is closed.
+// forced is closed if its deadline is expired while Close is blocked
+type blockingCloseConn struct {
+	net.Conn
+	release    chan struct{}
+	closing    chan struct{}
+	forced     chan struct{}
+	closeOnce  sync.Once
+	forcedOnce sync.Once
+}
+
+func (c *blockingCloseConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	<-c.release
+	return c.Conn.Close()
+}
+
+func (c *blockingCloseConn) SetDeadline(t time.Time) error {
+	select {
+	case <-c.closing:
+		c.forcedOnce.Do(func() { close(c.forced) })
+	default:
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func TestShutdownGraceForcesBlockedClose(t *testing.T) {
+	const grace = 300 * time.Millisecond
+	for _, drain := range []bool{false, true} {
+		t.Run(fmt.Sprintf("drain=%v", drain), func(t *testing.T) {
+			// The server never replies, so a draining client spends the
+			// whole grace waiting for the reply before closing
+			server := testutil.NewMockServer(testutil.Hang)
+			defer server.Close()
+			var conn *blockingCloseConn
+			release := make(chan struct{})
+			defer close(release)
+			config := testConfig(dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+				pipe, err := server.DialContext(ctx, network, address)
+				if err != nil {
+					return nil, err
+				}
+				conn = &blockingCloseConn{
+					Conn:    pipe,
+					release: release,
+					closing: make(chan struct{}),
+					forced:  make(chan struct{}),
+				}
+				return conn, nil
+			}))
+			config.ShutdownGrace = grace
+			config.DrainOnShutdown = drain
+			client := NewClient(config)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelled := make(chan time.Time, 1)
+			time.AfterFunc(50*time.Millisecond, func() {
+				cancelled <- time.Now()
+				cancel()
+			})
+			_, err := client.StartClientLoop(ctx)
+			end := time.Now()
+
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected context.Canceled, got %v", err)
+			}
+			// Draining and closing share one grace, they must not add up
+			if elapsed := end.Sub(<-cancelled); elapsed > grace*3/2 {
+				t.Errorf("expected the shutdown to take about %v, took %v", grace, elapsed)
+			}
+			if !drain {
+				select {
+				case <-conn.forced:
+				default:
+					t.Errorf("expected the connection to be force-closed")
+				}
+			}
+
+			// The blocked close must not keep the client locked
+			closed := make(chan error)
+			go func() { closed <- client.Close() }()
+			select {
+			case err := <-closed:
+				if err != nil {
+					t.Errorf("expected Close to succeed, got %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected Close not to block behind the stuck close")
+			}
+		})
+	}
+}
+
+func TestCancelAbortsSlowDial(t *testing.T) {
+	config := testConfig(hangingDialer)
+	config.ConnectTimeout = time.Minute
+	config.MaxConnectRetries = 5
+	client := NewClient(config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	stats, err := client.StartClientLoop(ctx)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the dial to be aborted promptly, took %v", elapsed)
+	}
+	if stats.Reconnects != 0 {
+		t.Errorf("expected a cancelled dial not to be retried, got %v reconnects", stats.Reconnects)
+	}
+}
+
+func TestOnReconnectFiresBeforeEveryRetry(t *testing.T) {
+	server := testutil.NewMockServer(testutil.CloseEarly)
+	defer server.Close()
+	dials := 0
+	config := testConfig(dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		if dials <= 2 {
+			return nil, errors.New("connection refused")
+		}
+		return server.DialContext(ctx, network, address)
+	}))
+	config.MaxConnectRetries = 5
+	config.MessageRetries = 1
+	client := NewClient(config)
+	var attempts []int
+	client.OnReconnect = func(attempt int, err error) {
+		if err == nil {
+			t.Errorf("expected the error causing the reconnect")
+		}
+		if got := client.Metrics().Reconnects; got != int64(len(attempts)+1) {
+			t.Errorf("expected the reconnect to be counted before the callback, got %v", got)
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	stats, err := client.StartClientLoop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two failed dials, then one resend after the dropped connection
+	if fmt.Sprint(attempts) != "[1 2 1]" {
+		t.Errorf("expected reconnect attempts [1 2 1], got %v", attempts)
+	}
+	if stats.Reconnects != 3 {
+		t.Errorf("expected 3 reconnects in the run stats, got %v", stats.Reconnects)
+	}
+}
+
+// chunkWriter Writer that accepts at most chunk bytes per call and fails
+// with err once failAfter bytes were written, if err is set
+type chunkWriter struct {
+	chunk     int
+	failAfter int
+	err       error
+	written   bytes.Buffer
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.err != nil && w.written.Len() >= w.failAfter {
+		return 0, w.err
+	}
+	if len(p) > w.chunk {
+		p = p[:w.chunk]
+	}
+	return w.written.Write(p)
+}
+
+func TestWriteFull(t *testing.T) {
+	writeErr := errors.New("connection reset")
+	tests := []struct {
+		name     string
+		writer   *chunkWriter
+		err      error
+		expected string
+	}{
+		{name: "one byte per write", writer: &chunkWriter{chunk: 1}, expected: "hello world\n"},
+		{name: "two bytes per write", writer: &chunkWriter{chunk: 2}, expected: "hello world\n"},
+		{name: "no progress", writer: &chunkWriter{chunk: 0}, err: io.ErrShortWrite},
+		{name: "error partway", writer: &chunkWriter{chunk: 2, failAfter: 4, err: writeErr}, err: writeErr, expected: "hell"},
+	}
+	for _, test := range tests {
+		err := writeFull(test.writer, []byte("hello world\n"))
+		if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+			t.Errorf("%v: expected error %v, got %v", test.name, test.err, err)
+		}
+		if test.writer.written.String() != test.expected {
+			t.Errorf("%v: expected %q written, got %q", test.name, test.expected, test.writer.written.String())
+		}
+	}
+}
+
+// logField Returns the value of the given `key: value` field of a log line
+func logField(line string, key string) string {
+	for _, part := range strings.Split(line, " | ") {
+		if value := strings.TrimPrefix(part, key+": "); value != part {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestConcurrentClientsLogThroughTheirOwnLogger(t *testing.T) {
+	var out bytes.Buffer
+	format := logging.MustStringFormatter(`%{module} %{message}`)
+	backend := logging.AddModuleLevel(logging.NewBackendFormatter(logging.NewLogBackend(&out, "", 0), format))
+
+	var wg sync.WaitGroup
+	for _, id := range []string{"A", "B"} {
+		logger := logging.MustGetLogger("client-" + id)
+		logger.SetBackend(backend)
+		server := testutil.NewMockServer()
+		defer server.Close()
+		config := testConfig(server)
+		config.ID = id
+		config.LoopAmount = 3
+		config.Logger = logger
+		client := NewClient(config)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.StartClientLoop(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	lines := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		module := strings.SplitN(line, " ", 2)[0]
+		id := strings.TrimPrefix(module, "client-")
+		if logged := logField(line, "client_id"); logged != id {
+			t.Errorf("expected the line to carry client_id %q, got %q in %q", id, logged, line)
+		}
+		lines[id]++
+	}
+	if lines["A"] == 0 || lines["A"] != lines["B"] {
+		t.Errorf("expected both clients to log the same amount of lines, got %v", lines)
+	}
+}
+
+func TestClientDefaultsToPackageLogger(t *testing.T) {
+	client := NewClient(testConfig(nil))
+	if client.log != log {
+		t.Errorf("expected the package logger when Logger is nil")
+	}
+}
+
+func TestReloadWhileLoopIsRunning(t *testing.T) {
+	server := testutil.NewMockServer()
+	defer server.Close()
+	config := testConfig(server)
+	config.LoopAmount = 20
+	config.LoopPeriod = time.Millisecond
+	config.MessageTimeout = time.Second
+	client := NewClient(config)
+
+	// Reload from another goroutine, like the SIGHUP handler does
+	done := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			updated := config
+			updated.MessageTimeout = time.Second + time.Duration(i%2)*time.Second
+			if err := client.Reload(updated); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	stats, err := client.StartClientLoop(context.Background())
+	close(done)
+	<-reloaded
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MessagesSent != config.LoopAmount {
+		t.Errorf("expected %v messages sent, got %v", config.LoopAmount, stats.MessagesSent)
+	}
+}
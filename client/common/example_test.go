@@ -0,0 +1,29 @@
+package common_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/testutil"
+)
+
+func ExampleClient_SendMessage() {
+	// The server drops the first connection, so the message is resent
+	server := testutil.NewMockServer(testutil.CloseEarly)
+	defer server.Close()
+
+	client := common.NewClient(common.ClientConfig{
+		ID:                 "1",
+		ServerAddress:      "server:12345",
+		LoopAmount:         1,
+		MessageRetries:     1,
+		ReconnectBaseDelay: time.Millisecond,
+		Dialer:             server,
+	})
+	reply, err := client.SendMessage(context.Background(), "hello")
+	fmt.Printf("reply: %q, error: %v, connections: %v\n", reply, err, server.Connections())
+	// Output:
+	// reply: "hello\n", error: <nil>, connections: 2
+}
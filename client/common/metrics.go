@@ -0,0 +1,63 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RunStats Summary of a single StartClientLoop run
+type RunStats struct {
+	MessagesSent int
+	Reconnects   int
+	Duration     time.Duration
+	// SendTime is the time spent writing messages and waiting for their
+	// replies, and AvgLatency that time divided by the exchanges made
+	SendTime   time.Duration
+	AvgLatency time.Duration
+}
+
+// Metrics Snapshot of the counters a client updates while it runs
+type Metrics struct {
+	MessagesSent   int64         `json:"messages_sent"`
+	SendFailures   int64         `json:"send_failures"`
+	Reconnects     int64         `json:"reconnects"`
+	CurrentMessage int64         `json:"current_message"`
+	Exchanges      int64         `json:"exchanges"`
+	WriteTime      time.Duration `json:"write_time_ns"`
+	WaitTime       time.Duration `json:"wait_time_ns"`
+}
+
+// clientMetrics Live counters of a client. They are updated from the client
+// loop and may be read concurrently (e.g. by the metrics endpoint), so they
+// must only be accessed through sync/atomic
+type clientMetrics struct {
+	messagesSent   int64
+	sendFailures   int64
+	reconnects     int64
+	currentMessage int64
+	exchanges      int64
+	writeNanos     int64
+	waitNanos      int64
+}
+
+// Metrics Returns a snapshot of the client counters. Safe to call while
+// StartClientLoop is running
+func (c *Client) Metrics() Metrics {
+	return Metrics{
+		MessagesSent:   atomic.LoadInt64(&c.metrics.messagesSent),
+		SendFailures:   atomic.LoadInt64(&c.metrics.sendFailures),
+		Reconnects:     atomic.LoadInt64(&c.metrics.reconnects),
+		CurrentMessage: atomic.LoadInt64(&c.metrics.currentMessage),
+		Exchanges:      atomic.LoadInt64(&c.metrics.exchanges),
+		WriteTime:      time.Duration(atomic.LoadInt64(&c.metrics.writeNanos)),
+		WaitTime:       time.Duration(atomic.LoadInt64(&c.metrics.waitNanos)),
+	}
+}
+
+// recordExchange Accounts the time spent writing a message and waiting
+// for its reply
+func (c *Client) recordExchange(writeTime time.Duration, waitTime time.Duration) {
+	atomic.AddInt64(&c.metrics.exchanges, 1)
+	atomic.AddInt64(&c.metrics.writeNanos, int64(writeTime))
+	atomic.AddInt64(&c.metrics.waitNanos, int64(waitTime))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// jsonBackend go-logging backend that writes every record as a single JSON
+// object per line. Messages following the `key: value | key: value` format
+// used across the client are split into one JSON field per key, so
+// `action`, `result`, `client_id` and the extra fields can be parsed
+// without regular expressions
+type jsonBackend struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newJSONBackend(out io.Writer) *jsonBackend {
+	return &jsonBackend{out: out}
+}
+
+// Log Implements logging.Backend
+func (b *jsonBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	fields := parseLogFields(rec.Message())
+	fields["time"] = rec.Time.Format("2006-01-02 15:04:05")
+	fields["level"] = level.String()
+
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err = b.out.Write(append(line, '\n'))
+	return err
+}
+
+// parseLogFields Splits a `key: value | key: value` log message into its
+// fields. Any part that is not a key/value pair is kept under `message`
+func parseLogFields(msg string) map[string]string {
+	fields := make(map[string]string)
+	var rest []string
+	for _, part := range strings.Split(msg, " | ") {
+		kv := strings.SplitN(part, ": ", 2)
+		if len(kv) != 2 || strings.ContainsAny(kv[0], " \t") {
+			rest = append(rest, part)
+			continue
+		}
+		fields[kv[0]] = strings.TrimSpace(kv[1])
+	}
+	if len(rest) > 0 {
+		fields["message"] = strings.Join(rest, " | ")
+	}
+	return fields
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestJSONBackendEmitsLogFields(t *testing.T) {
+	var out bytes.Buffer
+	logger := logging.MustGetLogger("json_test")
+	logger.SetBackend(logging.AddModuleLevel(newJSONBackend(&out)))
+
+	logger.Infof("action: receive_message | result: success | client_id: 1 | msg: [CLIENT 1] Message N°1")
+
+	var fields map[string]string
+	if err := json.Unmarshal(out.Bytes(), &fields); err != nil {
+		t.Fatalf("expected a JSON object, got %q: %v", out.String(), err)
+	}
+	expected := map[string]string{
+		"action":    "receive_message",
+		"result":    "success",
+		"client_id": "1",
+		"msg":       "[CLIENT 1] Message N°1",
+		"level":     "INFO",
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("expected %v to be %q, got %q", key, value, fields[key])
+		}
+	}
+	if fields["time"] == "" {
+		t.Errorf("expected a time field")
+	}
+}
+
+func TestParseLogFieldsKeepsFreeText(t *testing.T) {
+	fields := parseLogFields("Configuration could not be read | action: config | not a field")
+
+	if fields["action"] != "config" {
+		t.Errorf("expected action %q, got %q", "config", fields["action"])
+	}
+	expected := "Configuration could not be read | not a field"
+	if fields["message"] != expected {
+		t.Errorf("expected message %q, got %q", expected, fields["message"])
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/op/go-logging"
@@ -36,7 +43,28 @@ func InitConfig() (*viper.Viper, error) {
 	v.BindEnv("server", "address")
 	v.BindEnv("loop", "period")
 	v.BindEnv("loop", "amount")
+	v.BindEnv("message", "timeout")
+	v.BindEnv("message", "retries")
+	v.BindEnv("connect", "timeout")
+	v.BindEnv("reconnect", "maxRetries")
+	v.BindEnv("reconnect", "baseDelay")
+	v.BindEnv("reconnect", "maxDelay")
+	v.BindEnv("shutdown", "drain")
+	v.BindEnv("shutdown", "grace")
+	v.BindEnv("run", "maxDuration")
+	v.BindEnv("tcp", "noDelay")
+	// Go already disables Nagle's algorithm, keep it that way unless told otherwise
+	v.SetDefault("tcp.noDelay", true)
+	v.BindEnv("tcp", "keepAlive")
+	v.BindEnv("tls", "enabled")
+	v.BindEnv("tls", "caCert")
+	v.BindEnv("tls", "serverName")
+	v.BindEnv("tls", "cert")
+	v.BindEnv("tls", "key")
+	v.BindEnv("tls", "insecureSkipVerify")
 	v.BindEnv("log", "level")
+	v.BindEnv("log", "format")
+	v.BindEnv("metrics", "address")
 
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
@@ -53,20 +81,71 @@ func InitConfig() (*viper.Viper, error) {
 		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
 	}
 
+	if v.IsSet("message.timeout") {
+		if _, err := time.ParseDuration(v.GetString("message.timeout")); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_MESSAGE_TIMEOUT env var as time.Duration.")
+		}
+	}
+
+	if v.IsSet("connect.timeout") {
+		if _, err := time.ParseDuration(v.GetString("connect.timeout")); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_CONNECT_TIMEOUT env var as time.Duration.")
+		}
+	}
+
+	if v.IsSet("reconnect.baseDelay") {
+		if _, err := time.ParseDuration(v.GetString("reconnect.baseDelay")); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_RECONNECT_BASEDELAY env var as time.Duration.")
+		}
+	}
+
+	if v.IsSet("reconnect.maxDelay") {
+		if _, err := time.ParseDuration(v.GetString("reconnect.maxDelay")); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_RECONNECT_MAXDELAY env var as time.Duration.")
+		}
+	}
+
+	if v.IsSet("tcp.keepAlive") {
+		if _, err := time.ParseDuration(v.GetString("tcp.keepAlive")); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_TCP_KEEPALIVE env var as time.Duration.")
+		}
+	}
+
+	if v.IsSet("shutdown.grace") {
+		if _, err := time.ParseDuration(v.GetString("shutdown.grace")); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_SHUTDOWN_GRACE env var as time.Duration.")
+		}
+	}
+
+	if v.IsSet("run.maxDuration") {
+		if _, err := time.ParseDuration(v.GetString("run.maxDuration")); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_RUN_MAXDURATION env var as time.Duration.")
+		}
+	}
+
 	return v, nil
 }
 
-// InitLogger Receives the log level to be set in go-logging as a string. This method
-// parses the string and set the level to the logger. If the level string is not
-// valid an error is returned
-func InitLogger(logLevel string) error {
-	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
-	format := logging.MustStringFormatter(
-		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
-	)
-	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
+// InitLogger Receives the log level and format to be set in go-logging as strings.
+// This method parses the level and set it to the logger. The format can be "text"
+// (default) or "json", which emits every line as a JSON object. If the level or
+// the format are not valid an error is returned
+func InitLogger(logLevel string, logFormat string) error {
+	var backend logging.Backend
+	switch strings.ToLower(logFormat) {
+	case "", "text":
+		baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
+		format := logging.MustStringFormatter(
+			`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
+		)
+		backend = logging.NewBackendFormatter(baseBackend, format)
+	case "json":
+		backend = newJSONBackend(os.Stdout)
+	default:
+		return errors.Errorf("Invalid log format: %v", logFormat)
+	}
 
-	backendLeveled := logging.AddModuleLevel(backendFormatter)
+	backendLeveled := logging.AddModuleLevel(backend)
 	logLevelCode, err := logging.LogLevel(logLevel)
 	if err != nil {
 		return err
@@ -81,35 +160,155 @@ func InitLogger(logLevel string) error {
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s",
+	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | message_timeout: %v | log_level: %s",
 		v.GetString("id"),
 		v.GetString("server.address"),
 		v.GetInt("loop.amount"),
 		v.GetDuration("loop.period"),
+		v.GetDuration("message.timeout"),
 		v.GetString("log.level"),
 	)
 }
 
+// ReloadConfig Parses the configuration again and applies the settings
+// that can change at runtime (loop amount and period, message timeout)
+// to the client. If the configuration cannot be parsed or is not valid the
+// client keeps its current settings
+func ReloadConfig(client *common.Client, clientID string) {
+	v, err := InitConfig()
+	if err != nil {
+		log.Errorf("action: reload_config | result: fail | client_id: %v | error: %v", clientID, err)
+		return
+	}
+
+	err = client.Reload(common.ClientConfig{
+		LoopAmount:     v.GetInt("loop.amount"),
+		LoopPeriod:     v.GetDuration("loop.period"),
+		MessageTimeout: v.GetDuration("message.timeout"),
+	})
+	if err != nil {
+		log.Errorf("action: reload_config | result: fail | client_id: %v | error: %v", clientID, err)
+		return
+	}
+	log.Infof("action: reload_config | result: success | client_id: %v | loop_amount: %v | loop_period: %v | message_timeout: %v",
+		clientID,
+		v.GetInt("loop.amount"),
+		v.GetDuration("loop.period"),
+		v.GetDuration("message.timeout"),
+	)
+}
+
+// metricsClient Client whose counters are published through expvar
+var (
+	metricsClient  atomic.Value
+	publishMetrics sync.Once
+)
+
+// PublishMetrics Publishes the client counters through expvar under the
+// "client" name, so they are served in /debug/vars. expvar names can only
+// be published once, so later calls publish the counters of the new client
+// under the same name instead
+func PublishMetrics(client *common.Client) {
+	metricsClient.Store(client)
+	publishMetrics.Do(func() {
+		expvar.Publish("client", expvar.Func(func() interface{} {
+			return metricsClient.Load().(*common.Client).Metrics()
+		}))
+	})
+}
+
 func main() {
 	v, err := InitConfig()
 	if err != nil {
 		log.Criticalf("%s", err)
+		os.Exit(1)
 	}
 
-	if err := InitLogger(v.GetString("log.level")); err != nil {
+	if err := InitLogger(v.GetString("log.level"), v.GetString("log.format")); err != nil {
 		log.Criticalf("%s", err)
+		os.Exit(1)
 	}
 
 	// Print program config with debugging purposes
 	PrintConfig(v)
 
 	clientConfig := common.ClientConfig{
-		ServerAddress: v.GetString("server.address"),
-		ID:            v.GetString("id"),
-		LoopAmount:    v.GetInt("loop.amount"),
-		LoopPeriod:    v.GetDuration("loop.period"),
+		ServerAddress:      v.GetString("server.address"),
+		ID:                 v.GetString("id"),
+		LoopAmount:         v.GetInt("loop.amount"),
+		LoopPeriod:         v.GetDuration("loop.period"),
+		MessageTimeout:     v.GetDuration("message.timeout"),
+		MessageRetries:     v.GetInt("message.retries"),
+		ConnectTimeout:     v.GetDuration("connect.timeout"),
+		MaxConnectRetries:  v.GetInt("reconnect.maxRetries"),
+		ReconnectBaseDelay: v.GetDuration("reconnect.baseDelay"),
+		ReconnectMaxDelay:  v.GetDuration("reconnect.maxDelay"),
+		UseTLS:             v.GetBool("tls.enabled"),
+		CACertPath:         v.GetString("tls.caCert"),
+		ServerName:         v.GetString("tls.serverName"),
+		CertPath:           v.GetString("tls.cert"),
+		KeyPath:            v.GetString("tls.key"),
+		InsecureSkipVerify: v.GetBool("tls.insecureSkipVerify"),
+		DrainOnShutdown:    v.GetBool("shutdown.drain"),
+		ShutdownGrace:      v.GetDuration("shutdown.grace"),
+		MaxRunDuration:     v.GetDuration("run.maxDuration"),
+		DisableNoDelay:     !v.GetBool("tcp.noDelay"),
+		KeepAlivePeriod:    v.GetDuration("tcp.keepAlive"),
 	}
 
+	if err := clientConfig.Validate(); err != nil {
+		log.Criticalf("%s", err)
+		os.Exit(1)
+	}
+
+	// Cancel the client loop when the container is asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
 	client := common.NewClient(clientConfig)
-	client.StartClientLoop()
+
+	// Reload the loop settings on SIGHUP without restarting the client
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			ReloadConfig(client, clientConfig.ID)
+		}
+	}()
+
+	// Expose the client counters through expvar (/debug/vars) if enabled
+	if metricsAddress := v.GetString("metrics.address"); metricsAddress != "" {
+		PublishMetrics(client)
+		go func() {
+			if err := http.ListenAndServe(metricsAddress, nil); err != nil {
+				log.Errorf("action: metrics_server | result: fail | client_id: %v | error: %v",
+					clientConfig.ID,
+					err,
+				)
+			}
+		}()
+	}
+
+	// A shutdown requested through a signal or the run reaching its
+	// maximum duration are clean stops, not failures
+	stats, err := client.StartClientLoop(ctx)
+	failed := err != nil &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+	result := "success"
+	if failed {
+		result = "fail"
+	}
+	log.Infof("action: run_summary | result: %v | client_id: %v | messages_sent: %v | reconnects: %v | duration: %v | send_time: %v | avg_latency: %v",
+		result,
+		clientConfig.ID,
+		stats.MessagesSent,
+		stats.Reconnects,
+		stats.Duration,
+		stats.SendTime,
+		stats.AvgLatency,
+	)
+	if failed {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/testutil"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the client logs out of the test output
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+	os.Exit(m.Run())
+}
+
+func TestMetricsEndpointReflectsRun(t *testing.T) {
+	server := testutil.NewMockServer(testutil.CloseEarly)
+	defer server.Close()
+	client := common.NewClient(common.ClientConfig{
+		ID:             "1",
+		ServerAddress:  "server:12345",
+		LoopAmount:     3,
+		MessageRetries: 1,
+		Dialer:         server,
+	})
+	PublishMetrics(client)
+	if _, err := client.StartClientLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := httptest.NewServer(expvar.Handler())
+	defer endpoint.Close()
+	resp, err := http.Get(endpoint.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var vars struct {
+		Client common.Metrics `json:"client"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Client.MessagesSent != 3 {
+		t.Errorf("expected 3 messages sent, got %v", vars.Client.MessagesSent)
+	}
+	if vars.Client.Reconnects != 1 {
+		t.Errorf("expected 1 reconnect, got %v", vars.Client.Reconnects)
+	}
+	if vars.Client.CurrentMessage != 3 {
+		t.Errorf("expected current message 3, got %v", vars.Client.CurrentMessage)
+	}
+	if vars.Client.SendFailures != 0 {
+		t.Errorf("expected no send failures, got %v", vars.Client.SendFailures)
+	}
+}
+
+func TestReloadConfigFromEnv(t *testing.T) {
+	server := testutil.NewMockServer()
+	defer server.Close()
+	client := common.NewClient(common.ClientConfig{
+		ID:            "1",
+		ServerAddress: "server:12345",
+		LoopAmount:    1,
+		Dialer:        server,
+	})
+	run := func() int {
+		stats, err := client.StartClientLoop(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.MessagesSent
+	}
+
+	// An invalid reload keeps the current settings
+	t.Setenv("CLI_LOOP_AMOUNT", "3")
+	t.Setenv("CLI_LOOP_PERIOD", "-1s")
+	ReloadConfig(client, "1")
+	if sent := run(); sent != 1 {
+		t.Errorf("expected the loop amount to be kept at 1, got %v messages sent", sent)
+	}
+
+	t.Setenv("CLI_LOOP_PERIOD", "1ms")
+	ReloadConfig(client, "1")
+	if sent := run(); sent != 3 {
+		t.Errorf("expected the reloaded loop amount of 3, got %v messages sent", sent)
+	}
+}
+
+func TestInitConfigRejectsInvalidDuration(t *testing.T) {
+	t.Setenv("CLI_LOOP_PERIOD", "5s")
+	t.Setenv("CLI_CONNECT_TIMEOUT", "soon")
+
+	if _, err := InitConfig(); err == nil {
+		t.Errorf("expected an unparseable CLI_CONNECT_TIMEOUT to be rejected")
+	}
+}
@@ -0,0 +1,190 @@
+// Package testutil Helpers to test the client against a server whose
+// behaviour can be scripted
+package testutil
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action What the mock server does with a connection after reading the
+// message sent through it
+type Action int
+
+const (
+	// Echo Replies with the message followed by a newline and closes the
+	// connection, like the real server does
+	Echo Action = iota
+	// Hang Keeps the connection open without replying until the client
+	// or the mock server closes it
+	Hang
+	// CloseEarly Closes the connection without replying
+	CloseEarly
+	// Truncate Writes the first half of the reply, without the newline,
+	// and closes the connection
+	Truncate
+)
+
+// MockServer In-memory server speaking the client protocol: one line per
+// connection, answered with an echo of it. Every connection is handled
+// with the next Action of its script, and with Echo once the script is
+// exhausted. Connections are opened through DialContext, which makes the
+// MockServer usable as a common.Dialer, or through TCP after Listen
+type MockServer struct {
+	// ReplyDelay is waited before replying to every message. It must be
+	// set before the first connection is opened
+	ReplyDelay time.Duration
+
+	mu       sync.Mutex
+	script   []Action
+	accepted int
+	received []string
+	conns    map[net.Conn]struct{}
+	listener net.Listener
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewMockServer Initializes a mock server that handles its connections
+// with the given actions, in order
+func NewMockServer(script ...Action) *MockServer {
+	return &MockServer{
+		script: script,
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// DialContext Opens an in-memory connection to the mock server. The
+// network and address are ignored
+func (s *MockServer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	client, server := net.Pipe()
+	if !s.serve(server) {
+		client.Close()
+		return nil, net.ErrClosed
+	}
+	return client, nil
+}
+
+// Listen Makes the mock server also accept TCP connections on address
+// (e.g. "127.0.0.1:0") and returns the address it is listening on
+func (s *MockServer) Listen(address string) (string, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if !s.serve(conn) {
+				conn.Close()
+				return
+			}
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// Received Returns the messages read by the mock server so far, without
+// their trailing newline
+func (s *MockServer) Received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// Connections Returns the amount of connections opened to the mock server
+func (s *MockServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// Close Stops accepting connections and closes the open ones, unblocking
+// the connections handled with Hang. It waits for every handler to finish
+func (s *MockServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// serve Handles conn in a new goroutine with the next action of the
+// script. It returns false if the mock server is already closed
+func (s *MockServer) serve(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	action := Echo
+	if s.accepted < len(s.script) {
+		action = s.script[s.accepted]
+	}
+	s.accepted++
+	s.conns[conn] = struct{}{}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.handle(conn, action)
+
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	return true
+}
+
+// handle Reads a message from conn and answers it according to action
+func (s *MockServer) handle(conn net.Conn, action Action) {
+	msg, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+
+	s.mu.Lock()
+	s.received = append(s.received, msg)
+	s.mu.Unlock()
+
+	if action == Echo || action == Truncate {
+		time.Sleep(s.ReplyDelay)
+	}
+	switch action {
+	case Echo:
+		io.WriteString(conn, msg+"\n")
+	case Hang:
+		io.Copy(ioutil.Discard, conn)
+	case Truncate:
+		io.WriteString(conn, msg[:len(msg)/2])
+	case CloseEarly:
+	}
+}
@@ -0,0 +1,60 @@
+package testutil_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/testutil"
+)
+
+// exchange Sends a single message through conn and returns the reply
+func exchange(conn net.Conn, msg string) (string, error) {
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%v\n", msg); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func ExampleMockServer() {
+	// The first connection is dropped without a reply, later ones are echoed
+	server := testutil.NewMockServer(testutil.CloseEarly)
+	defer server.Close()
+
+	for i := 1; i <= 2; i++ {
+		conn, err := server.DialContext(context.Background(), "tcp", "server:12345")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		reply, err := exchange(conn, fmt.Sprintf("message %v", i))
+		fmt.Printf("reply: %q, error: %v\n", reply, err)
+	}
+	fmt.Println(server.Received())
+	// Output:
+	// reply: "", error: EOF
+	// reply: "message 2\n", error: <nil>
+	// [message 1 message 2]
+}
+
+func ExampleMockServer_Listen() {
+	server := testutil.NewMockServer()
+	defer server.Close()
+
+	address, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	reply, err := exchange(conn, "hello")
+	fmt.Printf("reply: %q, error: %v, connections: %v\n", reply, err, server.Connections())
+	// Output:
+	// reply: "hello\n", error: <nil>, connections: 1
+}